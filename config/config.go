@@ -0,0 +1,36 @@
+package config
+
+import (
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the top level configuration loaded from the --config file. It is
+// safe to use the zero value when no config file is supplied.
+type Config struct {
+	HelmRegistries Registries      `yaml:"helm_registries"`
+	VersionPolicy  VersionPolicies `yaml:"versionPolicy"`
+}
+
+// New loads a Config from file. An empty file path returns a zero-value
+// Config so helm-exporter keeps working without any registry overrides.
+func New(file string) Config {
+	config := Config{}
+	if file == "" {
+		return config
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Warnf("error reading config %s: %v", file, err)
+		return config
+	}
+
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		log.Fatalf("error parsing config %s: %v", file, err)
+	}
+
+	return config
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver"
+	log "github.com/sirupsen/logrus"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/registry"
+)
+
+const defaultRegistryCacheTTL = 10 * time.Minute
+
+type ociCacheEntry struct {
+	version   string
+	expiresAt time.Time
+}
+
+var (
+	ociCacheMu sync.Mutex
+	ociCache   = map[string]ociCacheEntry{}
+)
+
+// findOCISource returns the first oci:// source listed for a chart, if any.
+func findOCISource(sources []string) (string, bool) {
+	for _, source := range sources {
+		if strings.HasPrefix(source, "oci://") {
+			return source, true
+		}
+	}
+	return "", false
+}
+
+// getLatestOCIVersion resolves the newest tag published for an OCI chart
+// reference that policy accepts, using the matching Registry config (if any)
+// for auth, and caching the result for that registry's TTL so we don't
+// hammer the registry on every scrape.
+func (r Registries) getLatestOCIVersion(chart, ref string, policy VersionPolicy) string {
+	reg := r.findByURL(ref)
+	ttl := defaultRegistryCacheTTL
+	if reg != nil {
+		if d, err := time.ParseDuration(reg.CacheTTL); err == nil && d > 0 {
+			ttl = d
+		}
+	}
+
+	cacheKey := ref + "|" + policy.Range
+	ociCacheMu.Lock()
+	entry, ok := ociCache[cacheKey]
+	ociCacheMu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.version
+	}
+
+	version, err := resolveOCITag(ref, reg, policy)
+	if err != nil {
+		log.WithField("chart", chart).WithField("ref", ref).Warnf("failed to resolve latest OCI tag: %v", err)
+		return ""
+	}
+
+	ociCacheMu.Lock()
+	ociCache[cacheKey] = ociCacheEntry{version: version, expiresAt: time.Now().Add(ttl)}
+	ociCacheMu.Unlock()
+
+	return version
+}
+
+// newRegistryClient builds an OCI registry client that reuses whatever
+// session `helm registry login` already established: it defaults to Helm's
+// own RegistryConfig path (~/.config/helm/registry/config.json, honoring
+// $HELM_REGISTRY_CONFIG), then lets DOCKER_CONFIG override it for users who
+// authenticate via `docker login` instead.
+func newRegistryClient() (*registry.Client, error) {
+	credentialsFile := cli.New().RegistryConfig
+	if dockerConfig := os.Getenv("DOCKER_CONFIG"); dockerConfig != "" {
+		credentialsFile = filepath.Join(dockerConfig, "config.json")
+	}
+	return registry.NewClient(registry.ClientOptCredentialsFile(credentialsFile))
+}
+
+// resolveOCITag lists the tags published at ref (an oci:// chart reference)
+// and returns the newest one that parses as semver and that policy accepts.
+// Falls back to the credentials stored by `helm registry login` (or
+// DOCKER_CONFIG) when reg doesn't carry explicit auth.
+func resolveOCITag(ref string, reg *Registry, policy VersionPolicy) (string, error) {
+	client, err := newRegistryClient()
+	if err != nil {
+		return "", err
+	}
+
+	repo := strings.TrimPrefix(ref, "oci://")
+	if reg != nil {
+		if username, password := reg.credentials(); username != "" || password != "" {
+			host := repo
+			if idx := strings.Index(host, "/"); idx != -1 {
+				host = host[:idx]
+			}
+			if err := client.Login(host, registry.LoginOptBasicAuth(username, password)); err != nil {
+				return "", fmt.Errorf("login to %s: %w", host, err)
+			}
+		}
+	}
+
+	tags, err := client.Tags(repo)
+	if err != nil {
+		return "", err
+	}
+
+	var latest *semver.Version
+	for _, tag := range tags {
+		v, err := semver.NewVersion(tag)
+		if err != nil || !policy.Accepts(v) {
+			continue
+		}
+		if latest == nil || v.GreaterThan(latest) {
+			latest = v
+		}
+	}
+	if latest == nil {
+		return "", fmt.Errorf("no acceptable tags found for %s", ref)
+	}
+
+	return latest.String(), nil
+}
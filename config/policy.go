@@ -0,0 +1,121 @@
+package config
+
+import (
+	"github.com/Masterminds/semver"
+	log "github.com/sirupsen/logrus"
+)
+
+// VersionPolicy controls how helm-exporter decides whether a chart is
+// outdated and how severe the available update is.
+type VersionPolicy struct {
+	// Range scopes which upgrades count as "acceptable", e.g. "~1.2" to only
+	// flag patch releases, or ">=1.2 <2.0" to pin below the next major.
+	// Empty means any version greater than the installed one is acceptable.
+	Range string `yaml:"range"`
+	// IncludePrerelease allows pre-release versions (e.g. 1.4.0-rc1) to be
+	// considered. Defaults to false.
+	IncludePrerelease bool `yaml:"includePrerelease"`
+	// IgnoreVersions excludes specific known-bad releases from consideration.
+	IgnoreVersions []string `yaml:"ignoreVersions"`
+}
+
+// VersionPolicies is the versionPolicy config block: a Default applied to
+// every chart, optionally overridden per chart name.
+type VersionPolicies struct {
+	Default VersionPolicy            `yaml:"default"`
+	Charts  map[string]VersionPolicy `yaml:"charts"`
+}
+
+// For returns the policy that applies to chart, falling back to Default.
+func (p VersionPolicies) For(chart string) VersionPolicy {
+	if policy, ok := p.Charts[chart]; ok {
+		return policy
+	}
+	return p.Default
+}
+
+func (p VersionPolicy) ignores(v *semver.Version) bool {
+	for _, ignored := range p.IgnoreVersions {
+		if v.String() == ignored || v.Original() == ignored {
+			return true
+		}
+	}
+	return false
+}
+
+// Accepts reports whether v is an acceptable upgrade candidate under p: not
+// explicitly ignored, not a pre-release unless allowed, and within Range
+// when one is configured.
+func (p VersionPolicy) Accepts(v *semver.Version) bool {
+	if p.ignores(v) {
+		return false
+	}
+	if !p.IncludePrerelease && v.Prerelease() != "" {
+		return false
+	}
+	if p.Range != "" {
+		constraint, err := semver.NewConstraint(p.Range)
+		if err != nil {
+			log.WithField("range", p.Range).Warnf("invalid versionPolicy range, treating as not accepted: %v", err)
+			return false
+		}
+		if !constraint.Check(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// UpdateSeverity classifies how large a jump from the installed version to
+// the latest acceptable one is.
+type UpdateSeverity int
+
+const (
+	// SeverityNone means no outdated update was found.
+	SeverityNone UpdateSeverity = iota
+	SeverityPatch
+	SeverityMinor
+	SeverityMajor
+)
+
+// String renders the severity the way it's published as a metric label.
+func (s UpdateSeverity) String() string {
+	switch s {
+	case SeverityMajor:
+		return "major"
+	case SeverityMinor:
+		return "minor"
+	case SeverityPatch:
+		return "patch"
+	default:
+		return "none"
+	}
+}
+
+// Evaluate compares current against latest and reports whether the release
+// should be flagged as outdated, along with the severity of that gap. latest
+// is expected to already be the newest version Accepts allows; Evaluate only
+// re-checks Accepts defensively before deriving the severity.
+func (p VersionPolicy) Evaluate(current, latest string) (outdated bool, severity UpdateSeverity) {
+	currentVersion, err := semver.NewVersion(current)
+	if err != nil {
+		return false, SeverityNone
+	}
+	latestVersion, err := semver.NewVersion(latest)
+	if err != nil {
+		return false, SeverityNone
+	}
+
+	if !latestVersion.GreaterThan(currentVersion) || !p.Accepts(latestVersion) {
+		return false, SeverityNone
+	}
+
+	switch {
+	case latestVersion.Major() != currentVersion.Major():
+		return true, SeverityMajor
+	case latestVersion.Minor() != currentVersion.Minor():
+		return true, SeverityMinor
+	default:
+		return true, SeverityPatch
+	}
+}
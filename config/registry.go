@@ -0,0 +1,189 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// repoRequestTimeout bounds a single index.yaml fetch so a slow or
+// unresponsive chart repository can't stall runStats' single writer
+// goroutine indefinitely.
+const repoRequestTimeout = 10 * time.Second
+
+type repoCacheEntry struct {
+	version   string
+	expiresAt time.Time
+}
+
+var (
+	repoCacheMu sync.Mutex
+	repoCache   = map[string]repoCacheEntry{}
+)
+
+// Registry holds the connection details for a single chart repository or OCI
+// registry consulted when resolving the latest published version of a chart.
+type Registry struct {
+	Name     string `yaml:"name"`
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Token    string `yaml:"token"`
+	// CacheTTL overrides how long a resolved version is cached for this
+	// registry, e.g. "15m". Defaults to defaultRegistryCacheTTL.
+	CacheTTL string `yaml:"cache_ttl"`
+}
+
+// Registries is the collection of repositories/registries configured for
+// latest-version lookups.
+type Registries []Registry
+
+func (r Registry) isOCI() bool {
+	return strings.HasPrefix(r.URL, "oci://")
+}
+
+func (r Registry) credentials() (username, password string) {
+	if r.Username != "" || r.Password != "" {
+		return r.Username, r.Password
+	}
+	return "", r.Token
+}
+
+func (r Registries) findByURL(ref string) *Registry {
+	for i := range r {
+		if strings.HasPrefix(ref, r[i].URL) {
+			return &r[i]
+		}
+	}
+	return nil
+}
+
+// GetLatestVersionFromHelm returns the newest version of chart accepted by
+// policy. If any of the release's sources is an oci:// reference it is
+// resolved against an OCI registry, otherwise every configured classic chart
+// repository is consulted via its index.yaml.
+func (r Registries) GetLatestVersionFromHelm(ctx context.Context, chart string, sources []string, policy VersionPolicy) string {
+	if ref, ok := findOCISource(sources); ok {
+		return r.getLatestOCIVersion(chart, ref, policy)
+	}
+
+	var latest *semver.Version
+	for _, registry := range r {
+		if registry.isOCI() {
+			continue
+		}
+
+		version, err := registry.cachedLatestRepoVersion(ctx, chart, policy)
+		if err != nil {
+			log.WithField("chart", chart).WithField("registry", registry.Name).Debugf("could not resolve latest version: %v", err)
+			continue
+		}
+
+		v, err := semver.NewVersion(version)
+		if err != nil {
+			continue
+		}
+		if latest == nil || v.GreaterThan(latest) {
+			latest = v
+		}
+	}
+
+	if latest == nil {
+		return ""
+	}
+	return latest.String()
+}
+
+// cachedLatestRepoVersion wraps latestRepoVersion with the same per-registry
+// TTL cache getLatestOCIVersion uses, so a classic chart repository isn't
+// re-fetched on every scrape.
+func (reg Registry) cachedLatestRepoVersion(ctx context.Context, chart string, policy VersionPolicy) (string, error) {
+	ttl := defaultRegistryCacheTTL
+	if d, err := time.ParseDuration(reg.CacheTTL); err == nil && d > 0 {
+		ttl = d
+	}
+
+	cacheKey := reg.URL + "|" + chart + "|" + policy.Range
+	repoCacheMu.Lock()
+	entry, ok := repoCache[cacheKey]
+	repoCacheMu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.version, nil
+	}
+
+	version, err := latestRepoVersion(ctx, reg.URL, chart, policy)
+	if err != nil {
+		return "", err
+	}
+
+	repoCacheMu.Lock()
+	repoCache[cacheKey] = repoCacheEntry{version: version, expiresAt: time.Now().Add(ttl)}
+	repoCacheMu.Unlock()
+
+	return version, nil
+}
+
+type repoIndex struct {
+	Entries map[string][]struct {
+		Version string `yaml:"version"`
+	} `yaml:"entries"`
+}
+
+// latestRepoVersion fetches a classic chart repository's index.yaml and
+// returns the newest version published for chart that policy accepts. The
+// request is bounded by repoRequestTimeout so an unresponsive repository
+// can't hang the caller.
+func latestRepoVersion(ctx context.Context, url, chart string, policy VersionPolicy) (string, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, repoRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, strings.TrimRight(url, "/")+"/index.yaml", nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var index repoIndex
+	if err := yaml.Unmarshal(data, &index); err != nil {
+		return "", err
+	}
+
+	entries, ok := index.Entries[chart]
+	if !ok {
+		return "", fmt.Errorf("chart %s not found in %s", chart, url)
+	}
+
+	var latest *semver.Version
+	for _, entry := range entries {
+		v, err := semver.NewVersion(entry.Version)
+		if err != nil || !policy.Accepts(v) {
+			continue
+		}
+		if latest == nil || v.GreaterThan(latest) {
+			latest = v
+		}
+	}
+	if latest == nil {
+		return "", fmt.Errorf("no acceptable version found for chart %s in %s", chart, url)
+	}
+
+	return latest.String(), nil
+}
@@ -0,0 +1,47 @@
+// Package version holds the compile-time provenance of the helm-exporter
+// binary. The variables below are overridden via -ldflags at build time,
+// e.g.:
+//
+//	go build -ldflags "-X github.com/sstarcher/helm-exporter/internal/version.version=v1.2.3 \
+//	  -X github.com/sstarcher/helm-exporter/internal/version.gitCommit=$(git rev-parse HEAD) \
+//	  -X github.com/sstarcher/helm-exporter/internal/version.gitTreeState=clean \
+//	  -X github.com/sstarcher/helm-exporter/internal/version.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+var (
+	version      = "unknown"
+	gitCommit    = ""
+	gitTreeState = ""
+	buildDate    = "unknown"
+)
+
+// BuildInfo describes the provenance of the running binary.
+type BuildInfo struct {
+	Version      string `json:"version"`
+	GitCommit    string `json:"gitCommit"`
+	GitTreeState string `json:"gitTreeState"`
+	GoVersion    string `json:"goVersion"`
+	BuildDate    string `json:"buildDate"`
+}
+
+// Get returns the build information for the running binary.
+func Get() BuildInfo {
+	return BuildInfo{
+		Version:      version,
+		GitCommit:    gitCommit,
+		GitTreeState: gitTreeState,
+		GoVersion:    runtime.Version(),
+		BuildDate:    buildDate,
+	}
+}
+
+// String renders the build info as a single human-readable line.
+func (b BuildInfo) String() string {
+	return fmt.Sprintf("version.BuildInfo{Version:%q, GitCommit:%q, GitTreeState:%q, GoVersion:%q, BuildDate:%q}",
+		b.Version, b.GitCommit, b.GitTreeState, b.GoVersion, b.BuildDate)
+}
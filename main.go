@@ -1,17 +1,19 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/Masterminds/semver"
-
 	"github.com/sstarcher/helm-exporter/config"
+	"github.com/sstarcher/helm-exporter/internal/version"
 
 	cmap "github.com/orcaman/concurrent-map"
 
@@ -25,9 +27,13 @@ import (
 
 	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/release"
 
 	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
@@ -46,6 +52,10 @@ var (
 	statsTimestamp *prometheus.GaugeVec
 	statsOutdated  *prometheus.GaugeVec
 
+	statsInfoTTL      = newTTLTracker()
+	statsTimestampTTL = newTTLTracker()
+	statsOutdatedTTL  = newTTLTracker()
+
 	namespaces         = flag.String("namespaces", "", "namespaces to monitor.  Defaults to all")
 	namespacesIgnore   = flag.String("namespaces-ignore", "", "namespaces to ignore.  Defaults to none")
 	namespacesIgnoreRe []regexp.Regexp
@@ -53,6 +63,42 @@ var (
 
 	intervalDuration = flag.String("interval-duration", "0", "Enable metrics gathering in background, each given duration. If not provided, the helm stats are computed synchronously.  Default is 0")
 
+	metricTTL = flag.String("metric-ttl", "5m", "How long a series may go unobserved before it is pruned. Set to 0 to restore reset-every-scrape behavior.  Default is 5m")
+
+	leaderElect             = flag.Bool("leader-elect", false, "Only scrape helm/kubernetes from the replica that holds the leader election lease. Useful when running >1 replica for HA.  Defaults to false")
+	leaderElectionNamespace = flag.String("leader-election-namespace", "default", "Namespace of the Lease used for leader election.  Default is default")
+	leaderElectionID        = flag.String("leader-election-id", "helm-exporter", "Name of the Lease used for leader election.  Default is helm-exporter")
+
+	isLeading int32
+
+	// leaderCancel holds the context.CancelFunc for the current leadership
+	// term's run(), if any. OnStartedLeading and OnStoppedLeading run on
+	// different client-go goroutines with no ordering guarantee between
+	// them, so a bare shared variable would race; atomic.Value makes the
+	// handoff safe.
+	leaderCancel atomic.Value
+
+	isLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "helm_exporter_is_leader",
+		Help: "1 if this instance holds the leader-election lease (or leader election is disabled), 0 otherwise.",
+	})
+
+	scrapeConcurrency = flag.Int("scrape-concurrency", 8, "How many namespaces to list from helm storage concurrently.  Default is 8")
+	scrapeTimeout     = flag.String("scrape-timeout", "30s", "Per-namespace deadline for listing helm releases, so one wedged namespace can't stall the whole scrape.  Default is 30s")
+
+	scrapeDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "helm_exporter_scrape_duration_seconds",
+		Help: "How long it took to list helm releases in a namespace during the last scrape",
+	}, []string{"namespace"})
+	scrapeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "helm_exporter_scrape_errors_total",
+		Help: "Number of errors encountered listing helm releases in a namespace",
+	}, []string{"namespace"})
+	scrapeReleases = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "helm_exporter_releases_scraped",
+		Help: "Number of helm releases found in a namespace during the last scrape",
+	}, []string{"namespace"})
+
 	infoMetric      = flag.Bool("info-metric", true, "Generate info metric.  Defaults to true")
 	timestampMetric = flag.Bool("timestamp-metric", true, "Generate timestamps metric.  Defaults to true")
 	outdatedMetric  = flag.Bool("outdated-metric", true, "Generate version outdated metric.  Defaults to true")
@@ -76,6 +122,62 @@ var (
 	prometheusHandler = promhttp.Handler()
 )
 
+// ttlTracker records the last time each series (identified by its full label
+// tuple, see seriesKeyFor) was observed in a scrape, along with the label
+// values used to set it, so that
+// series can be individually expired once they exceed the configured TTL instead
+// of wiping the whole GaugeVec on every scrape.
+type ttlTracker struct {
+	mutex       sync.Mutex
+	lastSeen    map[string]time.Time
+	labelValues map[string][]string
+}
+
+func newTTLTracker() *ttlTracker {
+	return &ttlTracker{
+		lastSeen:    map[string]time.Time{},
+		labelValues: map[string][]string{},
+	}
+}
+
+// seriesKeyFor derives a ttlTracker key from a series' full label tuple. This
+// matters when a label changes (e.g. a chart upgrade bumps "version"): keying
+// by the full tuple tracks the old and new tuples as distinct entries, so the
+// old one keeps aging and eventually gets DeleteLabelValues'd by expire().
+// Keying by release identity alone would let touch() silently overwrite the
+// old tuple in labelValues, leaking that series in the GaugeVec forever.
+func seriesKeyFor(labelValues []string) string {
+	return strings.Join(labelValues, "\x00")
+}
+
+func (t *ttlTracker) touch(key string, labelValues []string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.lastSeen[key] = time.Now()
+	t.labelValues[key] = labelValues
+}
+
+// expire deletes series that haven't been touched within ttl from gauge and
+// forgets them. A ttl <= 0 is a no-op since the caller resets the GaugeVec
+// wholesale in that case.
+func (t *ttlTracker) expire(gauge *prometheus.GaugeVec, ttl time.Duration) {
+	if ttl <= 0 || gauge == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	for key, lastSeen := range t.lastSeen {
+		if now.Sub(lastSeen) > ttl {
+			gauge.DeleteLabelValues(t.labelValues[key]...)
+			delete(t.lastSeen, key)
+			delete(t.labelValues, key)
+		}
+	}
+}
+
 func configureMetrics() (info *prometheus.GaugeVec, timestamp *prometheus.GaugeVec, outdated *prometheus.GaugeVec) {
 	if *infoMetric == true {
 		info = prometheus.NewGaugeVec(prometheus.GaugeOpts{
@@ -110,39 +212,108 @@ func configureMetrics() (info *prometheus.GaugeVec, timestamp *prometheus.GaugeV
 	if *outdatedMetric == true {
 		outdated = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "helm_chart_outdated",
-			Help: "Outdated helm versions of helm releases",
+			Help: "Outdated helm versions of helm releases. Value is 1/2/3 for a patch/minor/major update per the configured versionPolicy.",
 		}, []string{
 			"chart",
 			"release",
 			"version",
 			"namespace",
-			"latestVersion"})
+			"latestVersion",
+			"updateSeverity"})
 	}
 
 	return
 }
 
-func runStats(config config.Config, info *prometheus.GaugeVec, timestamp *prometheus.GaugeVec, outdated *prometheus.GaugeVec) {
-	if info != nil {
-		info.Reset()
+// namespaceListResult is what a single worker hands back to the writer
+// goroutine after listing releases in one namespace.
+type namespaceListResult struct {
+	namespace string
+	items     []*release.Release
+	err       error
+	duration  time.Duration
+}
+
+// listNamespace runs action.List for a single namespace, bounded by
+// perNamespaceTimeout so one wedged namespace can't stall the whole scrape.
+func listNamespace(ctx context.Context, namespace string, client *action.Configuration, perNamespaceTimeout time.Duration) namespaceListResult {
+	if perNamespaceTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, perNamespaceTimeout)
+		defer cancel()
 	}
-	if timestamp != nil {
-		timestamp.Reset()
+
+	start := time.Now()
+	done := make(chan namespaceListResult, 1)
+	go func() {
+		items, err := action.NewList(client).Run()
+		done <- namespaceListResult{namespace: namespace, items: items, err: err}
+	}()
+
+	select {
+	case result := <-done:
+		result.duration = time.Since(start)
+		return result
+	case <-ctx.Done():
+		return namespaceListResult{namespace: namespace, err: ctx.Err(), duration: time.Since(start)}
 	}
+}
 
-	if outdated != nil {
-		outdated.Reset()
+func runStats(ctx context.Context, config config.Config, info *prometheus.GaugeVec, timestamp *prometheus.GaugeVec, outdated *prometheus.GaugeVec, ttl time.Duration, concurrency int, perNamespaceTimeout time.Duration) {
+	if ttl <= 0 {
+		if info != nil {
+			info.Reset()
+		}
+		if timestamp != nil {
+			timestamp.Reset()
+		}
+		if outdated != nil {
+			outdated.Reset()
+		}
 	}
 
-	for _, client := range clients.Items() {
-		list := action.NewList(client.(*action.Configuration))
-		items, err := list.Run()
-		if err != nil {
-			log.Warnf("got error while listing %v", err)
+	namespaceClients := clients.Items()
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make(chan namespaceListResult, len(namespaceClients))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for namespace, client := range namespaceClients {
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(namespace string, client *action.Configuration) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results <- listNamespace(ctx, namespace, client, perNamespaceTimeout)
+		}(namespace, client.(*action.Configuration))
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Everything below runs in this single goroutine, so it's the only writer
+	// touching the GaugeVecs - safe even though listing happens concurrently.
+	for result := range results {
+		scrapeDuration.WithLabelValues(result.namespace).Set(result.duration.Seconds())
+
+		if result.err != nil {
+			scrapeErrors.WithLabelValues(result.namespace).Inc()
+			log.Warnf("got error while listing %s: %v", result.namespace, result.err)
 			continue
 		}
 
-		for _, item := range items {
+		scrapeReleases.WithLabelValues(result.namespace).Set(float64(len(result.items)))
+
+		for _, item := range result.items {
 			chart := item.Chart.Name()
 			releaseName := item.Name
 			version := item.Chart.Metadata.Version
@@ -154,42 +325,54 @@ func runStats(config config.Config, info *prometheus.GaugeVec, timestamp *promet
 			description := item.Info.Description
 			latestVersion := ""
 
+			policy := config.VersionPolicy.For(chart)
 			if *fetchLatest {
-				latestVersion = config.HelmRegistries.GetLatestVersionFromHelm(item.Chart.Name())
+				latestVersion = config.HelmRegistries.GetLatestVersionFromHelm(ctx, item.Chart.Name(), item.Chart.Metadata.Sources, policy)
 			}
 
-			lv, err := semver.NewVersion(latestVersion)
-			if err == nil {
-				log.WithField("chart", chart).WithField("version", version).WithField("latest", latestVersion).Debug("Comparing versions")
-				lc, err := semver.NewConstraint(">" + version)
-				if err == nil {
-					a := lc.Check(lv)
-					if a {
-						if outdated != nil {
-							outdated.WithLabelValues(chart, releaseName, version, namespace, latestVersion).Set(1)
-						}
+			if isOutdated, sev := policy.Evaluate(version, latestVersion); isOutdated {
+				log.WithField("chart", chart).WithField("version", version).WithField("latest", latestVersion).WithField("severity", sev).Debug("Comparing versions")
+				if outdated != nil {
+					outdatedLabels := []string{chart, releaseName, version, namespace, latestVersion, sev.String()}
+					outdated.WithLabelValues(outdatedLabels...).Set(float64(sev))
+					if ttl > 0 {
+						statsOutdatedTTL.touch(seriesKeyFor(outdatedLabels), outdatedLabels)
 					}
-				} else {
-					log.WithField("chart", chart).WithField("version", version).WithField("latest", latestVersion).Error("%s", err)
 				}
 			}
 
 			if info != nil {
-				info.WithLabelValues(chart, releaseName, version, appVersion, strconv.FormatInt(int64(revision), 10), strconv.FormatInt(updated, 10), namespace, latestVersion, description).Set(status)
+				infoLabels := []string{chart, releaseName, version, appVersion, strconv.FormatInt(int64(revision), 10), strconv.FormatInt(updated, 10), namespace, latestVersion, description}
+				info.WithLabelValues(infoLabels...).Set(status)
+				if ttl > 0 {
+					statsInfoTTL.touch(seriesKeyFor(infoLabels), infoLabels)
+				}
 			}
 			if timestamp != nil {
-				timestamp.WithLabelValues(chart, releaseName, version, appVersion, strconv.FormatInt(updated, 10), namespace, latestVersion).Set(float64(updated))
+				timestampLabels := []string{chart, releaseName, version, appVersion, strconv.FormatInt(updated, 10), namespace, latestVersion}
+				timestamp.WithLabelValues(timestampLabels...).Set(float64(updated))
+				if ttl > 0 {
+					statsTimestampTTL.touch(seriesKeyFor(timestampLabels), timestampLabels)
+				}
 			}
 		}
 	}
+
+	statsInfoTTL.expire(info, ttl)
+	statsTimestampTTL.expire(timestamp, ttl)
+	statsOutdatedTTL.expire(outdated, ttl)
 }
 
-func runStatsPeriodically(interval time.Duration, config config.Config) {
+func runStatsPeriodically(ctx context.Context, interval time.Duration, config config.Config, ttl time.Duration, concurrency int, perNamespaceTimeout time.Duration) {
+	info, timestamp, outdated := configureMetrics()
+	registerMetrics(prometheus.DefaultRegisterer, info, timestamp, outdated)
 	for {
-		info, timestamp, outdated := configureMetrics()
-		runStats(config, info, timestamp, outdated)
-		registerMetrics(prometheus.DefaultRegisterer, info, timestamp, outdated)
-		time.Sleep(interval)
+		runStats(ctx, config, info, timestamp, outdated, ttl, concurrency, perNamespaceTimeout)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
 	}
 }
 
@@ -216,10 +399,46 @@ func registerMetrics(register prometheus.Registerer, info, timestamp *prometheus
 	statsOutdated = outdated
 }
 
-func newHelmStatsHandler(config config.Config, synchrone bool) http.HandlerFunc {
+// unregisterStatsMetrics removes the release-level collectors from register
+// and forgets them, and resets the per-namespace scrape metrics. Called when
+// this replica loses the leader-election lease, so a non-leader /metrics
+// response only carries helm_exporter_* gauges like is_leader instead of
+// serving the last leader's now-frozen, stale helm_chart_*/scrape_* series
+// forever. scrapeDuration/scrapeErrors/scrapeReleases stay registered (they're
+// registered once at startup, independent of leader election) but are reset
+// to empty so they don't keep reporting per-namespace values from before the
+// lease was lost.
+func unregisterStatsMetrics(register prometheus.Registerer) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if statsInfo != nil {
+		register.Unregister(statsInfo)
+		statsInfo = nil
+	}
+	if statsTimestamp != nil {
+		register.Unregister(statsTimestamp)
+		statsTimestamp = nil
+	}
+	if statsOutdated != nil {
+		register.Unregister(statsOutdated)
+		statsOutdated = nil
+	}
+
+	scrapeDuration.Reset()
+	scrapeErrors.Reset()
+	scrapeReleases.Reset()
+}
+
+func newHelmStatsHandler(config config.Config, synchrone bool, ttl time.Duration, concurrency int, perNamespaceTimeout time.Duration) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if *leaderElect && atomic.LoadInt32(&isLeading) == 0 {
+			prometheusHandler.ServeHTTP(w, r)
+			return
+		}
+
 		if synchrone {
-			runStats(config, statsInfo, statsTimestamp, statsOutdated)
+			runStats(r.Context(), config, statsInfo, statsTimestamp, statsOutdated, ttl, concurrency, perNamespaceTimeout)
 		} else {
 			mutex.RLock()
 			defer mutex.RUnlock()
@@ -233,6 +452,25 @@ func healthz(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(version.Get()); err != nil {
+		log.Warnf("failed to write version response: %v", err)
+	}
+}
+
+// registerBuildInfoMetric publishes a constant helm_exporter_build_info gauge
+// so operators can alert on version skew across a fleet of exporters.
+func registerBuildInfoMetric(register prometheus.Registerer) {
+	buildInfo := version.Get()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "helm_exporter_build_info",
+		Help: "A metric with a constant '1' value labeled by version, revision, goversion, treestate and builddate from which helm-exporter was built.",
+	}, []string{"version", "revision", "goversion", "treestate", "builddate"})
+	gauge.WithLabelValues(buildInfo.Version, buildInfo.GitCommit, buildInfo.GoVersion, buildInfo.GitTreeState, buildInfo.BuildDate).Set(1)
+	register.MustRegister(gauge)
+}
+
 func connect(namespace string) {
 	actionConfig := new(action.Configuration)
 	err := actionConfig.Init(settings.RESTClientGetter(), namespace, os.Getenv("HELM_DRIVER"), log.Infof)
@@ -244,22 +482,25 @@ func connect(namespace string) {
 	}
 }
 
-func informer() {
+// kubernetesClientSet builds a Kubernetes clientset the same way the rest of
+// helm-exporter talks to the cluster, via Helm's own RESTClientGetter.
+func kubernetesClientSet() (kubernetes.Interface, error) {
 	actionConfig := new(action.Configuration)
-	err := actionConfig.Init(settings.RESTClientGetter(), settings.Namespace(), os.Getenv("HELM_DRIVER"), log.Infof)
-	if err != nil {
-		log.Fatal(err)
+	if err := actionConfig.Init(settings.RESTClientGetter(), settings.Namespace(), os.Getenv("HELM_DRIVER"), log.Infof); err != nil {
+		return nil, err
 	}
 
-	clientset, err := actionConfig.KubernetesClientSet()
+	return actionConfig.KubernetesClientSet()
+}
+
+func informer(ctx context.Context) {
+	clientset, err := kubernetesClientSet()
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	factory := informers.NewSharedInformerFactory(clientset, 0)
 	informer := factory.Core().V1().Namespaces().Informer()
-	stopper := make(chan struct{})
-	defer close(stopper)
 
 	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
@@ -285,7 +526,61 @@ func informer() {
 		},
 	})
 
-	informer.Run(stopper)
+	informer.Run(ctx.Done())
+}
+
+// runLeaderElected runs run only while this process holds the leader
+// election lease, cancelling its context and flipping isLeader/isLeading to
+// 0 the moment the lease is lost.
+func runLeaderElected(run func(ctx context.Context)) {
+	clientset, err := kubernetesClientSet()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	id, err := os.Hostname()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: v1.ObjectMeta{
+			Name:      *leaderElectionID,
+			Namespace: *leaderElectionNamespace,
+		},
+		Client: clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: id,
+		},
+	}
+
+	leaderelection.RunOrDie(context.Background(), leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				log.Infof("%s acquired the leader-election lease", id)
+				atomic.StoreInt32(&isLeading, 1)
+				isLeader.Set(1)
+
+				runCtx, cancel := context.WithCancel(leaderCtx)
+				leaderCancel.Store(cancel)
+				run(runCtx)
+			},
+			OnStoppedLeading: func() {
+				log.Infof("%s lost the leader-election lease", id)
+				atomic.StoreInt32(&isLeading, 0)
+				isLeader.Set(0)
+				unregisterStatsMetrics(prometheus.DefaultRegisterer)
+				if cancel, ok := leaderCancel.Load().(context.CancelFunc); ok && cancel != nil {
+					cancel()
+				}
+			},
+		},
+	})
 }
 
 func main() {
@@ -302,6 +597,16 @@ func main() {
 		log.Fatalf("invalid duration `%s`: %s", *intervalDuration, err)
 	}
 
+	runMetricTTL, err := time.ParseDuration(*metricTTL)
+	if err != nil {
+		log.Fatalf("invalid duration `%s`: %s", *metricTTL, err)
+	}
+
+	runScrapeTimeout, err := time.ParseDuration(*scrapeTimeout)
+	if err != nil {
+		log.Fatalf("invalid duration `%s`: %s", *scrapeTimeout, err)
+	}
+
 	for _, listItem := range strings.Split(*namespacesIgnore, ",") {
 		re, err := regexp.Compile(listItem)
 		if err != nil {
@@ -311,22 +616,36 @@ func main() {
 		}
 	}
 
-	if namespaces == nil || *namespaces == "" {
-		go informer()
-	} else {
-		for _, namespace := range strings.Split(*namespaces, ",") {
-			connect(namespace)
+	runScraping := func(ctx context.Context) {
+		if namespaces == nil || *namespaces == "" {
+			go informer(ctx)
+		} else {
+			for _, namespace := range strings.Split(*namespaces, ",") {
+				connect(namespace)
+			}
+		}
+
+		if runIntervalDuration != 0 {
+			go runStatsPeriodically(ctx, runIntervalDuration, config, runMetricTTL, *scrapeConcurrency, runScrapeTimeout)
+		} else {
+			info, timestamp, outdated := configureMetrics()
+			registerMetrics(prometheus.DefaultRegisterer, info, timestamp, outdated)
 		}
 	}
 
-	if runIntervalDuration != 0 {
-		go runStatsPeriodically(runIntervalDuration, config)
+	prometheus.MustRegister(isLeader, scrapeDuration, scrapeErrors, scrapeReleases)
+	if *leaderElect {
+		go runLeaderElected(runScraping)
 	} else {
-		info, timestamp, outdated := configureMetrics()
-		registerMetrics(prometheus.DefaultRegisterer, info, timestamp, outdated)
+		atomic.StoreInt32(&isLeading, 1)
+		isLeader.Set(1)
+		runScraping(context.Background())
 	}
 
-	http.HandleFunc("/metrics", newHelmStatsHandler(config, runIntervalDuration == 0))
+	registerBuildInfoMetric(prometheus.DefaultRegisterer)
+
+	http.HandleFunc("/metrics", newHelmStatsHandler(config, runIntervalDuration == 0, runMetricTTL, *scrapeConcurrency, runScrapeTimeout))
 	http.HandleFunc("/healthz", healthz)
+	http.HandleFunc("/version", versionHandler)
 	log.Fatal(http.ListenAndServe(":9571", nil))
 }
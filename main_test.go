@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTTLTestGauge() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "test_series",
+	}, []string{"release"})
+}
+
+func TestTTLTrackerSurvivesOneMissedScrape(t *testing.T) {
+	tracker := newTTLTracker()
+	gauge := newTTLTestGauge()
+	labels := []string{"myrelease"}
+	gauge.WithLabelValues(labels...).Set(1)
+	tracker.touch(seriesKeyFor(labels), labels)
+
+	// A scrape that didn't observe the release (e.g. a transient listing
+	// error) just calls expire(); well within the TTL that must be a no-op.
+	tracker.expire(gauge, time.Hour)
+
+	if got := testutil.CollectAndCount(gauge); got != 1 {
+		t.Fatalf("expected series to survive a missed scrape within TTL, got %d series", got)
+	}
+}
+
+func TestTTLTrackerExpiresAfterTTL(t *testing.T) {
+	tracker := newTTLTracker()
+	gauge := newTTLTestGauge()
+	labels := []string{"myrelease"}
+	gauge.WithLabelValues(labels...).Set(1)
+
+	key := seriesKeyFor(labels)
+	tracker.mutex.Lock()
+	tracker.lastSeen[key] = time.Now().Add(-time.Hour)
+	tracker.labelValues[key] = labels
+	tracker.mutex.Unlock()
+
+	tracker.expire(gauge, time.Minute)
+
+	if got := testutil.CollectAndCount(gauge); got != 0 {
+		t.Fatalf("expected series to be pruned once its TTL elapsed, got %d series", got)
+	}
+}
+
+func TestTTLZeroPreservesResetEveryScrapeBehavior(t *testing.T) {
+	tracker := newTTLTracker()
+	gauge := newTTLTestGauge()
+	labels := []string{"myrelease"}
+	gauge.WithLabelValues(labels...).Set(1)
+	tracker.touch(seriesKeyFor(labels), labels)
+
+	// runStats resets the GaugeVec itself when ttl <= 0; expire() must be a
+	// no-op in that case rather than trying to prune from the tracker.
+	gauge.Reset()
+	tracker.expire(gauge, 0)
+
+	if got := testutil.CollectAndCount(gauge); got != 0 {
+		t.Fatalf("expected gauge to stay empty after Reset() with ttl=0, got %d series", got)
+	}
+}